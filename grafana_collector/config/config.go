@@ -1,8 +1,13 @@
 package config
 
 import (
+	"path/filepath"
+	"sync/atomic"
+
 	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
 	"github.com/juju/errors"
+	"github.com/ngaut/log"
 )
 
 // Config contains configuration options.
@@ -11,6 +16,8 @@ type Config struct {
 	Font     font
 	Rect     map[string]rect
 	Position position
+	Render   render
+	Output   output
 }
 
 type grafana struct {
@@ -18,6 +25,15 @@ type grafana struct {
 	ClientTimeout int `toml:"client-timeout"`
 	ServerTimeout int `toml:"server-timeout"`
 	RetryInterval int `toml:"retry-interval"`
+
+	// MaxRetries bounds the attempts made to render a single panel before
+	// it's treated as failed (1 means no retry).
+	MaxRetries int `toml:"max-retries"`
+
+	// PartialOnError, when true, replaces a panel that still fails after
+	// MaxRetries with a placeholder image instead of aborting the whole
+	// report.
+	PartialOnError bool `toml:"partial-on-error"`
 }
 
 type font struct {
@@ -40,12 +56,34 @@ type position struct {
 	Br      float64
 }
 
+// render controls the panel/page rendering pipeline: how many panels are
+// fetched and prepared concurrently, how long preparing (decoding) one
+// dashboard's panels may take, how many panels may be queued waiting for a
+// prepare worker, and how panels are packed onto a page ("grid" or
+// "legacy-two-per-page"). MaxInFlight does not bound prepared pages: all of
+// a dashboard's pages are held until the last one is prepared.
+type render struct {
+	Workers     int    `toml:"workers"`
+	Timeout     int    `toml:"timeout"`
+	MaxInFlight int    `toml:"max-in-flight"`
+	Layout      string `toml:"layout"`
+}
+
+// output selects the artifact format Report.Generate produces when a
+// caller doesn't request one explicitly: "pdf", "html", "zip-of-pngs" or
+// "single-png".
+type output struct {
+	Format string `toml:"format"`
+}
+
 var defaultConf = Config{
 	Grafana: grafana{
-		Theme:         "dark",
-		ClientTimeout: 300,
-		ServerTimeout: 300,
-		RetryInterval: 10,
+		Theme:          "dark",
+		ClientTimeout:  300,
+		ServerTimeout:  300,
+		RetryInterval:  10,
+		MaxRetries:     3,
+		PartialOnError: false,
 	},
 	Font: font{
 		Family: "opensans",
@@ -74,17 +112,123 @@ var defaultConf = Config{
 		ImageY2: 370.0,
 		Br:      20.0,
 	},
+	Render: render{
+		Workers:     5,
+		Timeout:     300,
+		MaxInFlight: 20,
+		Layout:      "legacy-two-per-page",
+	},
+	Output: output{
+		Format: "pdf",
+	},
+}
+
+var globalConf atomic.Value // holds *Config
+
+func init() {
+	conf := newDefaultConfig()
+	globalConf.Store(conf)
 }
 
-var globalConf = defaultConf
+// newDefaultConfig returns a fresh copy of defaultConf. Config embeds the
+// Rect map, and copying a Config by value only copies the map header, so
+// every caller that wants an independent "defaults, then overlay a file"
+// Config must start here rather than copying defaultConf directly -
+// otherwise toml.DecodeFile's in-place map writes leak back into the
+// shared defaultConf.Rect and contaminate every other config derived from
+// it afterwards.
+func newDefaultConfig() *Config {
+	conf := defaultConf
+	conf.Rect = make(map[string]rect, len(defaultConf.Rect))
+	for k, v := range defaultConf.Rect {
+		conf.Rect[k] = v
+	}
+	return &conf
+}
 
-// GetGlobalConfig returns global configurations.
+// GetGlobalConfig returns the current global configuration. Safe to call
+// concurrently with a Watch-driven reload swapping it out.
 func GetGlobalConfig() *Config {
-	return &globalConf
+	return globalConf.Load().(*Config)
+}
+
+// LoadConfig reads configFile over a fresh copy of the defaults and
+// returns it, without touching the global configuration. Use this to build
+// a per-request override for report.NewWithConfig; use SetConfig to load
+// and also install a file as the global configuration.
+func LoadConfig(configFile string) (*Config, error) {
+	conf := newDefaultConfig()
+	if _, err := toml.DecodeFile(configFile, conf); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conf, nil
 }
 
-// SetConfig ... loads config options from a toml file.
+// SetConfig loads config options from a toml file, then installs the
+// result as the new global configuration.
+func SetConfig(configFile string) error {
+	conf, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	globalConf.Store(conf)
+	return nil
+}
+
+// SetConfig is the pre-existing method form of the package-level
+// SetConfig, kept so callers built against it still compile. c itself is
+// discarded - the decoded file is layered over a fresh copy of the
+// defaults and installed as the global configuration, same as SetConfig.
 func (c *Config) SetConfig(configFile string) error {
-	_, err := toml.DecodeFile(configFile, c)
-	return errors.Trace(err)
+	return SetConfig(configFile)
+}
+
+// Watch reloads configFile into the global configuration every time it
+// changes on disk, so a running process picks up edits without a restart.
+// It returns once the watch is established; reload errors are logged but do
+// not stop watching, so a bad edit doesn't wedge the process - the previous
+// good configuration stays in effect until a valid one is written.
+func Watch(configFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Watch the containing directory rather than the file itself: editors
+	// commonly save by renaming a temp file over the target, which a
+	// file-level watch would miss after the first write.
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return errors.Trace(err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(configFile) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				reloaded, err := LoadConfig(configFile)
+				if err != nil {
+					log.Errorf("reloading config %s error: %v", configFile, err)
+					continue
+				}
+				globalConf.Store(reloaded)
+				log.Infof("reloaded config from %s", configFile)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("watching config %s error: %v", configFile, err)
+			}
+		}
+	}()
+	return nil
 }
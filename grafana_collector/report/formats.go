@@ -0,0 +1,205 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/grafana"
+	"github.com/pkg/errors"
+)
+
+// Format selects the artifact encoding Report.Generate produces.
+type Format string
+
+// The output formats a Report can be encoded as.
+const (
+	FormatPDF       Format = "pdf"
+	FormatHTML      Format = "html"
+	FormatZIPPNGs   Format = "zip-of-pngs"
+	FormatSinglePNG Format = "single-png"
+)
+
+// Artifact is a generated report in a particular Format.
+type Artifact struct {
+	Body        io.ReadCloser
+	ContentType string
+	FileName    string
+}
+
+// GenerateResult is what Report.Generate returns: the rendered Artifact,
+// plus any panels that still failed to render after retries. FailedPanels
+// is only non-empty when Grafana.PartialOnError let the report finish
+// anyway; callers (e.g. the HTTP handler) can use it to warn the caller
+// that the report is incomplete.
+type GenerateResult struct {
+	Artifact     Artifact
+	FailedPanels []FailedPanel
+}
+
+// encodeHTML renders a self-contained HTML page with the dashboard's time
+// range header and one section per panel, image embedded as a base64 PNG.
+func (rep *report) encodeHTML(dash grafana.Dashboard, pages []preparedPage, failedPanels []FailedPanel) (Artifact, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>")
+	buf.WriteString(html.EscapeString(dash.Title))
+	buf.WriteString("</title></head><body>\n")
+	buf.WriteString("<h1>Dashboard: " + html.EscapeString(dash.Title) + "</h1>\n")
+	buf.WriteString("<p>" + html.EscapeString(rep.time.FromFormatted()+" to "+rep.time.ToFormatted()) + "</p>\n")
+	writeFailedPanelsHTML(&buf, failedPanels)
+
+	for _, page := range pages {
+		buf.WriteString("<h2>Row: " + html.EscapeString(page.panel.RowTitle) + ", Panel: " + html.EscapeString(page.panel.Title) + "</h2>\n")
+		buf.WriteString("<img src=\"data:image/png;base64,")
+		buf.WriteString(base64.StdEncoding.EncodeToString(page.raw))
+		buf.WriteString("\">\n")
+	}
+	buf.WriteString("</body></html>\n")
+
+	return Artifact{
+		Body:        ioutil.NopCloser(&buf),
+		ContentType: "text/html; charset=utf-8",
+		FileName:    "report.html",
+	}, nil
+}
+
+// writeFailedPanelsHTML appends a summary listing panels that still failed
+// to render after retries, if any.
+func writeFailedPanelsHTML(buf *bytes.Buffer, failedPanels []FailedPanel) {
+	if len(failedPanels) == 0 {
+		return
+	}
+	buf.WriteString("<h2>Failed panels</h2>\n<ul>\n")
+	for _, f := range failedPanels {
+		buf.WriteString("<li>" + html.EscapeString(fmt.Sprintf("%s: %s", f.Title, f.Error)) + "</li>\n")
+	}
+	buf.WriteString("</ul>\n")
+}
+
+// zipManifestPanel describes one panel's PNG inside a zip-of-pngs report.
+type zipManifestPanel struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	RowTitle string `json:"row_title"`
+	File     string `json:"file"`
+}
+
+// zipManifest is written alongside the panel PNGs as manifest.json.
+type zipManifest struct {
+	Dashboard string             `json:"dashboard"`
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Panels    []zipManifestPanel `json:"panels"`
+}
+
+// encodeZIP streams every panel PNG plus a manifest.json describing them
+// into a single zip archive.
+func (rep *report) encodeZIP(dash grafana.Dashboard, pages []preparedPage, failedPanels []FailedPanel) (Artifact, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	manifest := zipManifest{
+		Dashboard: dash.Title,
+		From:      rep.time.FromFormatted(),
+		To:        rep.time.ToFormatted(),
+		Panels:    make([]zipManifestPanel, 0, len(pages)),
+	}
+	for _, page := range pages {
+		fileName := rep.imgFileName(page.panel)
+		w, err := zw.Create(fileName)
+		if err != nil {
+			return Artifact{}, errors.Errorf("creating zip entry %s error: %v", fileName, err)
+		}
+		if _, err := w.Write(page.raw); err != nil {
+			return Artifact{}, errors.Errorf("writing zip entry %s error: %v", fileName, err)
+		}
+		manifest.Panels = append(manifest.Panels, zipManifestPanel{
+			ID:       page.panel.ID,
+			Title:    page.panel.Title,
+			RowTitle: page.panel.RowTitle,
+			File:     fileName,
+		})
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "marshal manifest")
+	}
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "creating manifest.json entry")
+	}
+	if _, err := w.Write(manifestJSON); err != nil {
+		return Artifact{}, errors.Wrap(err, "writing manifest.json entry")
+	}
+
+	if err := zw.Close(); err != nil {
+		return Artifact{}, errors.Wrap(err, "close zip")
+	}
+
+	return Artifact{
+		Body:        ioutil.NopCloser(&buf),
+		ContentType: "application/zip",
+		FileName:    "report.zip",
+	}, nil
+}
+
+// encodeSinglePNG stacks every panel PNG vertically into one tall image.
+func (rep *report) encodeSinglePNG(dash grafana.Dashboard, pages []preparedPage, failedPanels []FailedPanel) (Artifact, error) {
+	imgs := make([]image.Image, len(pages))
+	var width, height int
+	for i, page := range pages {
+		img, _, err := image.Decode(bytes.NewReader(page.raw))
+		if err != nil {
+			return Artifact{}, errors.Errorf("decoding panel %d png error: %v", page.panel.ID, err)
+		}
+		imgs[i] = img
+		if w := img.Bounds().Dx(); w > width {
+			width = w
+		}
+		height += img.Bounds().Dy()
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+
+	var y int
+	for _, img := range imgs {
+		dstRect := image.Rect(0, y, img.Bounds().Dx(), y+img.Bounds().Dy())
+		draw.Draw(canvas, dstRect, img, img.Bounds().Min, draw.Src)
+		y += img.Bounds().Dy()
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return Artifact{}, errors.Wrap(err, "encode png")
+	}
+
+	return Artifact{
+		Body:        ioutil.NopCloser(&buf),
+		ContentType: "image/png",
+		FileName:    "report.png",
+	}, nil
+}
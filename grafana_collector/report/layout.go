@@ -0,0 +1,146 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/grafana"
+	"github.com/signintech/gopdf"
+)
+
+const (
+	// gridColumns is the width, in Grafana grid units, that a dashboard's
+	// gridPos.x/gridPos.w are relative to.
+	gridColumns = 24.0
+
+	// pxPerPoint converts gopdf points (72 per inch) to the pixels Grafana
+	// renders panel PNGs at (96 per inch), so requested PNG sizes and grid
+	// rectangles agree.
+	pxPerPoint = 96.0 / 72.0
+
+	// gridRowHeightPx is Grafana's GRID_CELL_HEIGHT: a gridPos.h unit is
+	// always this many pixels, independent of dashboard width. It is a
+	// different physical size than a gridPos.w unit (contentWidth /
+	// gridColumns), so the two axes need separate scale factors or every
+	// non-square panel comes out distorted.
+	gridRowHeightPx = 30.0
+
+	layoutGrid   = "grid"
+	layoutLegacy = "legacy-two-per-page"
+)
+
+// panelRect returns the PDF rectangle a panel should be drawn into.
+//
+// With the legacy layout every panel gets one of two fixed rects depending
+// on its type. With the grid layout the rect is derived from the panel's
+// Grafana dashboard gridPos: width is scaled to the page's content width,
+// height from the fixed Grafana row unit, so panels keep the relative size
+// and shape they had on the dashboard.
+func (rep *report) panelRect(p grafana.Panel) *gopdf.Rect {
+	c := rep.cfg()
+	if c.Render.Layout != layoutGrid {
+		if p.IsSingleStat() {
+			return &gopdf.Rect{W: c.Rect["singlestat"].Width, H: c.Rect["singlestat"].Height}
+		}
+		return &gopdf.Rect{W: c.Rect["graph"].Width, H: c.Rect["graph"].Height}
+	}
+
+	widthUnit := rep.contentWidth() / gridColumns
+	heightUnit := gridRowHeightPx / pxPerPoint
+	return &gopdf.Rect{W: float64(p.GridPos.W) * widthUnit, H: float64(p.GridPos.H) * heightUnit}
+}
+
+func (rep *report) contentWidth() float64 {
+	c := rep.cfg()
+	return c.Rect["page"].Width - 2*c.Position.X
+}
+
+// targetPixelSize returns the pixel width/height to request from Grafana
+// for a panel's PNG, matching the rect it will actually be drawn at so
+// images aren't upscaled (or needlessly downscaled) in the PDF.
+func (rep *report) targetPixelSize(p grafana.Panel) (width, height int) {
+	rect := rep.panelRect(p)
+	return int(rect.W * pxPerPoint), int(rect.H * pxPerPoint)
+}
+
+// writePanels draws pages onto pdf using the configured layout.
+func (rep *report) writePanels(pdf *gopdf.GoPdf, pages []preparedPage) error {
+	if rep.cfg().Render.Layout == layoutGrid {
+		return rep.writePanelsGrid(pdf, pages)
+	}
+	for _, page := range pages {
+		if err := rep.writePage(pdf, page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePanelsGrid packs panels left-to-right within a dashboard row,
+// wrapping to a new line when a row overflows the page width and to a new
+// page when it overflows the page height. A row's title (shared by every
+// panel fetched from the same Grafana dashboard row) is printed as a
+// section header the first time that row is seen.
+func (rep *report) writePanelsGrid(pdf *gopdf.GoPdf, pages []preparedPage) error {
+	pos := rep.cfg().Position
+	contentWidth := rep.contentWidth()
+	pageBottom := rep.cfg().Rect["page"].Height - pos.Br
+
+	x, y := pos.X, pos.ImageY1
+	rowHeight := 0.0
+	currentRow := ""
+	seenRow := false
+
+	for _, page := range pages {
+		if !seenRow || page.panel.RowTitle != currentRow {
+			if seenRow {
+				y += rowHeight + pos.Br
+			}
+			x, rowHeight = pos.X, 0
+			currentRow, seenRow = page.panel.RowTitle, true
+
+			if currentRow != "" {
+				pdf.SetX(x)
+				pdf.SetY(y)
+				pdf.Cell(nil, "Row: "+currentRow)
+				y += pos.Br
+			}
+		}
+
+		rect := page.rect
+		if x+rect.W > pos.X+contentWidth {
+			x, y = pos.X, y+rowHeight+pos.Br
+			rowHeight = 0
+		}
+		if y+rect.H > pageBottom {
+			pdf.AddPage()
+			x, y, rowHeight = pos.X, pos.ImageY1, 0
+		}
+
+		pdf.SetX(x)
+		pdf.SetY(y)
+		pdf.Cell(nil, page.panel.Title)
+		if err := pdf.ImageByHolder(page.image, x, y+pos.Br, rect); err != nil {
+			log.Errorf("rendering panel %d to PDF error: %v", page.panel.ID, err)
+		} else {
+			log.Infof("rendering panel %d to PDF", page.panel.ID)
+		}
+
+		x += rect.W
+		if rect.H > rowHeight {
+			rowHeight = rect.H
+		}
+	}
+	return nil
+}
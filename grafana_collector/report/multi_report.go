@@ -0,0 +1,149 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ngaut/log"
+	"github.com/pborman/uuid"
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/grafana"
+	"github.com/pkg/errors"
+)
+
+// multiReport generates a single combined PDF covering every dashboard
+// matched by a Grafana provisioning folder or tag, with one section
+// (and one outline/bookmark entry) per dashboard.
+type multiReport struct {
+	gClient  grafana.Client
+	selector grafana.DashboardSelector
+	time     grafana.TimeRange
+	tmpDir   string
+}
+
+// NewMulti creates a Report covering every dashboard matched by selector,
+// producing one combined PDF with per-dashboard sections, each reachable
+// from one PDF outline (bookmark) entry; no table-of-contents page is
+// printed. It is meant for Grafana's provisioned dashboards, where
+// operators group related dashboards under a folder or a common tag and
+// want one inspection report instead of invoking the collector once per
+// dashboard UID.
+func NewMulti(g grafana.Client, selector grafana.DashboardSelector, timeRange grafana.TimeRange) Report {
+	return &multiReport{g, selector, timeRange, filepath.Join("tmp", uuid.New())}
+}
+
+// Clean deletes the temporary directory used during report generation
+func (m *multiReport) Clean() {
+	err := os.RemoveAll(m.tmpDir)
+	if err != nil {
+		log.Errorf("cleaning up tmp dir %s error: %v", m.tmpDir, err)
+	}
+}
+
+// Generate returns the combined report as a single PDF GenerateResult.
+// After reading its Artifact.Body it should be Closed(), then Clean()
+// called to delete the temporary build files.
+func (m *multiReport) Generate() (GenerateResult, error) {
+	dashNames, err := m.gClient.ListDashboards(m.selector)
+	if err != nil {
+		return GenerateResult{}, errors.Errorf("listing dashboards for selector %+v error: %v", m.selector, err)
+	}
+	if len(dashNames) == 0 {
+		return GenerateResult{}, errors.Errorf("no dashboards matched selector %+v", m.selector)
+	}
+
+	reps := make([]*report, len(dashNames))
+	dashes := make([]grafana.Dashboard, len(dashNames))
+	var failedPanels []FailedPanel
+	for i, name := range dashNames {
+		r := newReport(m.gClient, name, m.time, FormatPDF, nil)
+		// Panel IDs are numbered per-dashboard, so two dashboards in the
+		// same folder routinely reuse the same ID. Give each report its
+		// own image subdirectory; otherwise a later dashboard's panel PNG
+		// silently overwrites an earlier one with the same ID before
+		// renderCombinedPDF reads them back.
+		r.tmpDir = filepath.Join(m.tmpDir, fmt.Sprintf("dash%d", i))
+		reps[i] = r
+
+		dash, err := r.gClient.GetDashboard(r.dashName)
+		if err != nil {
+			return GenerateResult{}, errors.Errorf("fetching dashboard %s error: %v", r.dashName, err)
+		}
+		dashes[i] = dash
+
+		err = os.MkdirAll(r.imgDirPath(), 0777)
+		if err != nil {
+			return GenerateResult{}, errors.Errorf("creating image directory %s error: %v", r.imgDirPath(), err)
+		}
+
+		// Reuse the same bounded worker pool a single-dashboard report
+		// uses: it already caps concurrent Grafana requests, so fetching
+		// panels dashboard-by-dashboard for a whole folder is safe.
+		failed, err := r.renderPNGsParallel(dash)
+		if err != nil {
+			return GenerateResult{}, errors.Errorf("rendering PNGs in parallel for dash %+v error: %v", dash, err)
+		}
+		failedPanels = append(failedPanels, failed...)
+	}
+
+	artifact, err := m.renderCombinedPDF(reps, dashes, failedPanels)
+	if err != nil {
+		return GenerateResult{}, errors.Errorf("rendering combined pdf for selector %+v error: %v", m.selector, err)
+	}
+	return GenerateResult{Artifact: artifact, FailedPanels: failedPanels}, nil
+}
+
+func (m *multiReport) pdfPath() string {
+	return filepath.Join(m.tmpDir, reportPdf)
+}
+
+// renderCombinedPDF lays out one section per dashboard, each opening with
+// its own home page, and adds a top-level outline entry per section so
+// readers can jump straight to a dashboard from the PDF's bookmarks. The
+// failed-panel summary (if any) is only printed once, on the first
+// dashboard's home page, since it isn't broken down per dashboard.
+func (m *multiReport) renderCombinedPDF(reps []*report, dashes []grafana.Dashboard, failedPanels []FailedPanel) (Artifact, error) {
+	pdf, err := reps[0].NewPDF()
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "new pdf file")
+	}
+
+	for i, r := range reps {
+		dash := dashes[i]
+		pages, err := r.preparePanels(dash)
+		if err != nil {
+			return Artifact{}, errors.Errorf("preparing panels for dash %+v error: %v", dash, err)
+		}
+
+		var homeFailedPanels []FailedPanel
+		if i == 0 {
+			homeFailedPanels = failedPanels
+		}
+		r.createHomePage(pdf, dash, homeFailedPanels)
+		pdf.AddOutlineWithPosition(dash.Title)
+		if err := r.writePanels(pdf, pages); err != nil {
+			return Artifact{}, err
+		}
+	}
+
+	// WritePdf(pdfPath string) func in gopdf doesn't return error
+	pdf.WritePdf(m.pdfPath())
+	f, err := os.Open(m.pdfPath())
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "open pdf file")
+	}
+	return Artifact{Body: f, ContentType: "application/pdf", FileName: "report.pdf"}, nil
+}
@@ -32,9 +32,11 @@ package report
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/ngaut/log"
 	"github.com/pborman/uuid"
@@ -44,23 +46,25 @@ import (
 	"github.com/signintech/gopdf"
 )
 
-var (
-	cfg = config.GetGlobalConfig()
-
-	// FontDir ... ttf font directory
-	FontDir = ""
-)
+// FontDir ... ttf font directory
+var FontDir = ""
 
 const (
 	imgDir    = "images"
 	reportPdf = "report.pdf"
+
+	// defaultRenderTimeout bounds preparePanels for a single dashboard when
+	// the effective Render.Timeout isn't set (e.g. a zero-value Config in
+	// tests).
+	defaultRenderTimeout = 300 * time.Second
 )
 
 // Report groups functions related to genrating the report.
-// After reading and closing the pdf returned by Generate(),
-// call Clean() to delete the pdf file as well the temporary build files
+// After reading and closing the Artifact's Body in the GenerateResult
+// returned by Generate(), call Clean() to delete the pdf file as well the
+// temporary build files
 type Report interface {
-	Generate() (pdf io.ReadCloser, err error)
+	Generate() (GenerateResult, error)
 	Clean()
 }
 
@@ -69,6 +73,11 @@ type report struct {
 	time     grafana.TimeRange
 	dashName string
 	tmpDir   string
+	format   Format
+
+	// cfgOverride, when set (via NewWithConfig), is used instead of the
+	// global configuration for this report only.
+	cfgOverride *config.Config
 }
 
 // SetFontDir ... sets up ttf font directory
@@ -76,42 +85,93 @@ func SetFontDir(fontDir string) {
 	FontDir = fontDir
 }
 
-// New ... creates a new Report
+// New ... creates a new Report rendered in the globally configured format
 func New(g grafana.Client, dashName string, timeRange grafana.TimeRange) Report {
-	return new(g, dashName, timeRange)
+	return newReport(g, dashName, timeRange, "", nil)
+}
+
+// NewWithFormat ... creates a new Report rendered in format, overriding the
+// globally configured default. Intended for callers (e.g. the HTTP
+// handler's "format" query parameter) that need one report in a different
+// format without touching global config.
+func NewWithFormat(g grafana.Client, dashName string, timeRange grafana.TimeRange, format Format) Report {
+	return newReport(g, dashName, timeRange, format, nil)
 }
 
-func new(g grafana.Client, dashName string, timeRange grafana.TimeRange) *report {
+// NewWithConfig ... creates a new Report that renders as format using
+// cfgOverride instead of the global configuration, so one request can use a
+// different theme, font size or page size without mutating global state.
+func NewWithConfig(g grafana.Client, dashName string, timeRange grafana.TimeRange, format Format, cfgOverride *config.Config) Report {
+	return newReport(g, dashName, timeRange, format, cfgOverride)
+}
+
+func newReport(g grafana.Client, dashName string, timeRange grafana.TimeRange, format Format, cfgOverride *config.Config) *report {
 	tmpDir := filepath.Join("tmp", uuid.New())
-	return &report{g, timeRange, dashName, tmpDir}
+	return &report{g, timeRange, dashName, tmpDir, format, cfgOverride}
+}
+
+// cfg returns this report's effective configuration: its per-request
+// override if one was supplied via NewWithConfig, otherwise the current
+// global configuration (which config.Watch may hot-swap at any time).
+func (rep *report) cfg() *config.Config {
+	if rep.cfgOverride != nil {
+		return rep.cfgOverride
+	}
+	return config.GetGlobalConfig()
 }
 
-// Generate returns the report.pdf file. After reading this file it should be Closed()
-// After closing the file, call report.Clean() to delete the file
-func (rep *report) Generate() (pdf io.ReadCloser, err error) {
+// Generate returns the rendered report as a GenerateResult. After reading
+// its Artifact.Body it should be Closed(); after closing, call
+// report.Clean() to delete the temporary build files.
+func (rep *report) Generate() (GenerateResult, error) {
 	// prepare stage: fetch dashboard json and create image directory
 	dash, err := rep.gClient.GetDashboard(rep.dashName)
 	if err != nil {
-		return nil, errors.Errorf("fetching dashboard %s error: %v", rep.dashName, err)
+		return GenerateResult{}, errors.Errorf("fetching dashboard %s error: %v", rep.dashName, err)
 	}
 
 	err = os.MkdirAll(rep.imgDirPath(), 0777)
 	if err != nil {
-		return nil, errors.Errorf("creating image directory %s error: %v", rep.imgDirPath(), err)
+		return GenerateResult{}, errors.Errorf("creating image directory %s error: %v", rep.imgDirPath(), err)
 	}
 
 	// working stage：fetch panel images
-	err = rep.renderPNGsParallel(dash)
+	failedPanels, err := rep.renderPNGsParallel(dash)
 	if err != nil {
-		return nil, errors.Errorf("rendering PNGs in parallel for dash %+v error: %v. It is recommended to select time range within 6 hours on the Dashboard. Otherwise, the grafana timeout problem might occur.", dash, err)
+		return GenerateResult{}, errors.Errorf("rendering PNGs in parallel for dash %+v error: %v. It is recommended to select time range within 6 hours on the Dashboard. Otherwise, the grafana timeout problem might occur.", dash, err)
 	}
 
-	// working stage：render panel images to pdf
-	pdf, err = rep.renderPDF(dash)
+	// working stage：lay out panels, then hand them to the format encoder
+	pages, err := rep.preparePanels(dash)
 	if err != nil {
-		return nil, errors.Errorf("rendering pdf for dash %+v error: %v", dash, err)
+		return GenerateResult{}, errors.Errorf("preparing panels for dash %+v error: %v", dash, err)
+	}
+
+	artifact, err := rep.encode(dash, pages, failedPanels)
+	if err != nil {
+		return GenerateResult{}, errors.Errorf("encoding %s report for dash %+v error: %v", rep.format, dash, err)
+	}
+	return GenerateResult{Artifact: artifact, FailedPanels: failedPanels}, nil
+}
+
+// encode dispatches to the format-specific encoder for rep.format, falling
+// back to the effective config's Output.Format when rep.format is empty, and
+// to PDF when the resulting format is empty or not recognised.
+func (rep *report) encode(dash grafana.Dashboard, pages []preparedPage, failedPanels []FailedPanel) (Artifact, error) {
+	format := rep.format
+	if format == "" {
+		format = Format(rep.cfg().Output.Format)
+	}
+	switch format {
+	case FormatHTML:
+		return rep.encodeHTML(dash, pages, failedPanels)
+	case FormatZIPPNGs:
+		return rep.encodeZIP(dash, pages, failedPanels)
+	case FormatSinglePNG:
+		return rep.encodeSinglePNG(dash, pages, failedPanels)
+	default:
+		return rep.encodePDF(dash, pages, failedPanels)
 	}
-	return pdf, nil
 }
 
 // Clean deletes the temporary directory used during report generation
@@ -130,7 +190,12 @@ func (rep *report) pdfPath() string {
 	return filepath.Join(rep.tmpDir, reportPdf)
 }
 
-func (rep *report) renderPNGsParallel(dash grafana.Dashboard) error {
+// renderPNGsParallel fetches every panel's PNG, retrying failures with
+// backoff. If PartialOnError is off, the first panel that still fails after
+// retries aborts the whole report, as before. If it's on, failed panels are
+// replaced with a placeholder image and returned as failedPanels instead of
+// failing the report.
+func (rep *report) renderPNGsParallel(dash grafana.Dashboard) (failedPanels []FailedPanel, err error) {
 	//buffer all panels on a channel
 	panels := make(chan grafana.Panel, len(dash.Panels))
 	for _, p := range dash.Panels {
@@ -141,44 +206,48 @@ func (rep *report) renderPNGsParallel(dash grafana.Dashboard) error {
 	//fetch images in parrallel form Grafana sever.
 	//limit concurrency using a worker pool to avoid overwhelming grafana
 	//for dashboards with many panels.
-	var (
-		wg      sync.WaitGroup
-		workers = 5
-		errs    = make(chan error, len(dash.Panels)) //routines can return errors on a channel
-	)
+	workers := rep.cfg().Render.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	failures := make(chan FailedPanel, len(dash.Panels))
 
 	wg.Add(workers)
 	for i := 0; i < workers; i++ {
-		go func(panels <-chan grafana.Panel, errs chan<- error) {
+		go func(panels <-chan grafana.Panel, failures chan<- FailedPanel) {
 			defer wg.Done()
 			for p := range panels {
-				err := rep.renderPNG(p)
-				if err != nil {
-					log.Errorf("creating image for panel ID %d error: %v", p.ID, err)
-					errs <- err
+				if failed := rep.renderPNGWithRetry(p); failed != nil {
+					failures <- *failed
 				}
 			}
-		}(panels, errs)
+		}(panels, failures)
 	}
 	wg.Wait()
-	close(errs)
+	close(failures)
 
-	for err := range errs {
-		if err != nil {
-			return err
-		}
+	for f := range failures {
+		failedPanels = append(failedPanels, f)
 	}
-	return nil
+
+	if len(failedPanels) > 0 && !rep.cfg().Grafana.PartialOnError {
+		return failedPanels, errors.Errorf("rendering %d panel(s) failed after retries, first error: %s", len(failedPanels), failedPanels[0].Error)
+	}
+	return failedPanels, nil
+}
+
+func (rep *report) imgFileName(p grafana.Panel) string {
+	return fmt.Sprintf("image%d.png", p.ID)
 }
 
 func (rep *report) imgFilePath(p grafana.Panel) string {
-	imgFileName := fmt.Sprintf("image%d.png", p.ID)
-	imgFilePath := filepath.Join(rep.imgDirPath(), imgFileName)
-	return imgFilePath
+	return filepath.Join(rep.imgDirPath(), rep.imgFileName(p))
 }
 
 func (rep *report) renderPNG(p grafana.Panel) error {
-	body, err := rep.gClient.GetPanelPng(p, rep.dashName, rep.time)
+	width, height := rep.targetPixelSize(p)
+	body, err := rep.gClient.GetPanelPng(p, rep.dashName, rep.time, width, height)
 	if err != nil {
 		return errors.Errorf("getting panel %+v error: %v", p, err)
 	}
@@ -200,17 +269,18 @@ func (rep *report) renderPNG(p grafana.Panel) error {
 
 // NewPDF ... creates a new PDF and sets font
 func (rep *report) NewPDF() (*gopdf.GoPdf, error) {
+	c := rep.cfg()
 	pdf := &gopdf.GoPdf{}
-	pdf.Start(gopdf.Config{PageSize: gopdf.Rect{W: cfg.Rect["page"].Width, H: cfg.Rect["page"].Height}})
+	pdf.Start(gopdf.Config{PageSize: gopdf.Rect{W: c.Rect["page"].Width, H: c.Rect["page"].Height}})
 
-	ttfPath := FontDir + cfg.Font.Ttf
-	err := pdf.AddTTFFont(cfg.Font.Family, ttfPath)
+	ttfPath := FontDir + c.Font.Ttf
+	err := pdf.AddTTFFont(c.Font.Family, ttfPath)
 	if err != nil {
 		log.Errorf("add ttf font error: %v", err)
 		return nil, errors.Wrap(err, "add ttf font")
 	}
 
-	err = pdf.SetFont(cfg.Font.Family, "", cfg.Font.Size)
+	err = pdf.SetFont(c.Font.Family, "", c.Font.Size)
 	if err != nil {
 		log.Errorf("set font error: %v", err)
 		return nil, errors.Wrap(err, "set font")
@@ -219,63 +289,194 @@ func (rep *report) NewPDF() (*gopdf.GoPdf, error) {
 	return pdf, nil
 }
 
-// createHomePage ... add Home Page for PDF
-func (rep *report) createHomePage(pdf *gopdf.GoPdf, dash grafana.Dashboard) {
+// createHomePage ... add Home Page for PDF. When failedPanels is non-empty
+// (only possible with Grafana.PartialOnError), it also prints a summary of
+// which panels failed and their final error, so a partial report still
+// tells the reader what's missing.
+func (rep *report) createHomePage(pdf *gopdf.GoPdf, dash grafana.Dashboard, failedPanels []FailedPanel) {
+	pos := rep.cfg().Position
 	pdf.AddPage()
-	pdf.SetX(cfg.Position.X)
+	pdf.SetX(pos.X)
 	pdf.Cell(nil, "Dashboard: "+dash.Title)
-	pdf.Br(cfg.Position.Br)
-	pdf.SetX(cfg.Position.X)
+	pdf.Br(pos.Br)
+	pdf.SetX(pos.X)
 	pdf.Cell(nil, rep.time.FromFormatted()+" to "+rep.time.ToFormatted())
+
+	if len(failedPanels) == 0 {
+		return
+	}
+	pdf.Br(pos.Br)
+	pdf.SetX(pos.X)
+	pdf.Cell(nil, fmt.Sprintf("%d panel(s) failed to render:", len(failedPanels)))
+	for _, f := range failedPanels {
+		pdf.Br(pos.Br)
+		pdf.SetX(pos.X)
+		pdf.Cell(nil, fmt.Sprintf("- %s: %s", f.Title, f.Error))
+	}
 }
 
-func (rep *report) renderPDF(dash grafana.Dashboard) (outputPDF *os.File, err error) {
-	log.Infof("PDF templates config: %+v\n", cfg)
+// renderJob is one panel queued up for a prepare worker, tagged with its
+// position in dash.Panels so pages can be laid out back in panel order.
+type renderJob struct {
+	index int
+	panel grafana.Panel
+}
 
-	pdf, err := rep.NewPDF()
-	if err != nil {
-		return nil, errors.Wrap(err, "new pdf file")
+// preparedPage is the fully-prepared output of a prepare worker: everything
+// a format encoder needs, with no further file I/O or decoding required.
+type preparedPage struct {
+	index int
+	panel grafana.Panel
+	raw   []byte // original panel PNG bytes, for the html/zip/png encoders
+	image gopdf.ImageHolder
+	rect  *gopdf.Rect
+}
+
+// preparePanels decodes and scales every panel of dash, returning the
+// results as an ordered slice ready for any format encoder to consume. It
+// is the layout stage shared by encodePDF, encodeHTML, encodeZIP,
+// encodeSinglePNG and multiReport, so every output format gets the same
+// panels in the same order. Only the PDF encoders use each page's rect.
+//
+// Panels are prepared concurrently by a worker pool; each worker writes
+// only to its own slot of the result slice, so no further synchronization
+// is needed to keep them in dash.Panels order.
+func (rep *report) preparePanels(dash grafana.Dashboard) ([]preparedPage, error) {
+	c := rep.cfg()
+
+	// Bound how many panels are buffered waiting for a worker rather than
+	// queuing every panel up front. This bounds the job queue only: every
+	// decoded page is still kept in the returned slice.
+	maxInFlight := c.Render.MaxInFlight
+	if maxInFlight <= 0 || maxInFlight > len(dash.Panels) {
+		maxInFlight = len(dash.Panels)
+	}
+	if maxInFlight <= 0 {
+		maxInFlight = 1
 	}
-	rep.createHomePage(pdf, dash)
 
-	// setting rectangle size for grafana panel type: Graph/Singlestat
-	rectGraph := &gopdf.Rect{W: cfg.Rect["graph"].Width, H: cfg.Rect["graph"].Height}
-	rectSinglestat := &gopdf.Rect{W: cfg.Rect["singlestat"].Width, H: cfg.Rect["singlestat"].Height}
-	rect := &gopdf.Rect{}
+	jobs := make(chan renderJob, maxInFlight)
+	go func() {
+		defer close(jobs)
+		for i, p := range dash.Panels {
+			jobs <- renderJob{index: i, panel: p}
+		}
+	}()
 
-	var count int
-	for _, p := range dash.Panels {
-		imgPath := rep.imgFilePath(p)
+	workers := c.Render.Workers
+	if workers <= 0 {
+		workers = 1
+	}
 
-		if p.IsSingleStat() {
-			rect = rectSinglestat
-		} else {
-			rect = rectGraph
-		}
+	pages := make([]preparedPage, len(dash.Panels))
+	errs := make(chan error, len(dash.Panels))
 
-		// Add two images on every page
-		if count%2 == 0 {
-			pdf.SetX(cfg.Position.X)
-			pdf.SetY(cfg.Position.TitleY1)
-			pdf.Cell(nil, fmt.Sprintf("Row: %s, Panel: %s", p.RowTitle, p.Title))
-			err = pdf.Image(imgPath, cfg.Position.X, cfg.Position.ImageY1, rect)
-		} else {
-			pdf.SetX(cfg.Position.X)
-			pdf.SetY(cfg.Position.TitleY2)
-			pdf.Cell(nil, fmt.Sprintf("Row: %s, Panel: %s", p.RowTitle, p.Title))
-			err = pdf.Image(imgPath, cfg.Position.X, cfg.Position.ImageY2, rect)
-			pdf.AddPage()
-		}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				page, err := rep.preparePage(job)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				pages[job.index] = page
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(errs)
+		close(done)
+	}()
+
+	timeout := time.Duration(c.Render.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultRenderTimeout
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return nil, errors.Errorf("preparing panels for dash %s timed out after %s", dash.Title, timeout)
+	}
+
+	for err := range errs {
 		if err != nil {
-			log.Errorf("rendering image %s to PDF error: %v", imgPath, err)
-		} else {
-			log.Infof("rendering image to PDF: %s", imgPath)
+			return nil, err
 		}
-		count++
+	}
+	return pages, nil
+}
+
+// preparePage decodes a single panel's PNG and picks its target rectangle.
+// It does no writes to shared state and is safe to call from multiple
+// goroutines at once.
+func (rep *report) preparePage(job renderJob) (preparedPage, error) {
+	p := job.panel
+	imgPath := rep.imgFilePath(p)
+
+	raw, err := ioutil.ReadFile(imgPath)
+	if err != nil {
+		return preparedPage{}, errors.Errorf("reading image %s error: %v", imgPath, err)
+	}
+	image, err := gopdf.ImageHolderByBytes(raw)
+	if err != nil {
+		return preparedPage{}, errors.Errorf("decoding image %s error: %v", imgPath, err)
+	}
+
+	return preparedPage{index: job.index, panel: p, raw: raw, image: image, rect: rep.panelRect(p)}, nil
+}
+
+// writePage draws one prepared panel onto pdf, two panels per page. It is
+// shared by encodePDF and multiReport so a dashboard's panels are laid out
+// identically whether it is rendered on its own or as one section of a
+// combined report.
+func (rep *report) writePage(pdf *gopdf.GoPdf, page preparedPage) error {
+	pos := rep.cfg().Position
+	var err error
+	if page.index%2 == 0 {
+		pdf.SetX(pos.X)
+		pdf.SetY(pos.TitleY1)
+		pdf.Cell(nil, fmt.Sprintf("Row: %s, Panel: %s", page.panel.RowTitle, page.panel.Title))
+		err = pdf.ImageByHolder(page.image, pos.X, pos.ImageY1, page.rect)
+	} else {
+		pdf.SetX(pos.X)
+		pdf.SetY(pos.TitleY2)
+		pdf.Cell(nil, fmt.Sprintf("Row: %s, Panel: %s", page.panel.RowTitle, page.panel.Title))
+		err = pdf.ImageByHolder(page.image, pos.X, pos.ImageY2, page.rect)
+		pdf.AddPage()
+	}
+	if err != nil {
+		log.Errorf("rendering panel %d to PDF error: %v", page.panel.ID, err)
+		return nil
+	}
+	log.Infof("rendering panel %d to PDF", page.panel.ID)
+	return nil
+}
+
+// encodePDF lays pages out on a fresh PDF behind a home page, using the
+// configured Render.Layout, and returns it as an Artifact.
+func (rep *report) encodePDF(dash grafana.Dashboard, pages []preparedPage, failedPanels []FailedPanel) (Artifact, error) {
+	log.Infof("PDF templates config: %+v\n", rep.cfg())
+
+	pdf, err := rep.NewPDF()
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "new pdf file")
+	}
+	rep.createHomePage(pdf, dash, failedPanels)
+	if err := rep.writePanels(pdf, pages); err != nil {
+		return Artifact{}, err
 	}
 
 	// WritePdf(pdfPath string) func in gopdf doesn't return error
 	pdf.WritePdf(rep.pdfPath())
-	outputPDF, err = os.Open(rep.pdfPath())
-	return outputPDF, errors.Wrap(err, "open pdf file")
+	f, err := os.Open(rep.pdfPath())
+	if err != nil {
+		return Artifact{}, errors.Wrap(err, "open pdf file")
+	}
+	return Artifact{Body: f, ContentType: "application/pdf", FileName: "report.pdf"}, nil
 }
@@ -0,0 +1,98 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/config"
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/grafana"
+)
+
+// benchDashboard returns a dashboard fixture with n panels, standing in for
+// a real Grafana dashboard without needing a server to talk to.
+func benchDashboard(n int) grafana.Dashboard {
+	panels := make([]grafana.Panel, n)
+	for i := range panels {
+		panels[i] = grafana.Panel{
+			ID:      i + 1,
+			Title:   fmt.Sprintf("panel %d", i+1),
+			GridPos: grafana.GridPos{W: 12, H: 8},
+		}
+	}
+	return grafana.Dashboard{Title: "bench", Panels: panels}
+}
+
+// writeBenchPanelPNGs writes a tiny placeholder PNG for each panel into
+// rep's image directory, as if renderPNGsParallel had already fetched them,
+// so preparePanels has something to decode.
+func writeBenchPanelPNGs(b *testing.B, rep *report, dash grafana.Dashboard) {
+	b.Helper()
+	if err := os.MkdirAll(rep.imgDirPath(), 0777); err != nil {
+		b.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		b.Fatal(err)
+	}
+	body := buf.Bytes()
+
+	for _, p := range dash.Panels {
+		if err := ioutil.WriteFile(rep.imgFilePath(p), body, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPreparePanels demonstrates the worker pool's speedup over a
+// single-worker run for a dashboard with 30+ panels: Render.Workers=1
+// serializes every panel's decode, while Render.Workers=8 overlaps them.
+func BenchmarkPreparePanels(b *testing.B) {
+	dash := benchDashboard(32)
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tmpDir, err := ioutil.TempDir("", "report-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			cfgOverride := *config.GetGlobalConfig()
+			cfgOverride.Render.Workers = workers
+
+			rep := newReport(nil, "bench", grafana.TimeRange{}, FormatPDF, &cfgOverride)
+			rep.tmpDir = tmpDir
+			writeBenchPanelPNGs(b, rep, dash)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rep.preparePanels(dash); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
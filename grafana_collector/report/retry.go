@@ -0,0 +1,142 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb-inspect-tools/grafana_collector/grafana"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// defaultRetryInterval is the exponential backoff base used when
+// cfg.Grafana.RetryInterval isn't set.
+const defaultRetryInterval = 10 * time.Second
+
+// FailedPanel records a panel that could not be rendered even after
+// retrying, and (when PartialOnError is enabled) was replaced with a
+// placeholder image.
+type FailedPanel struct {
+	PanelID int
+	Title   string
+	Error   string
+}
+
+// statusCoder is implemented by grafana client errors that carry the
+// Grafana HTTP response status, so the placeholder image can show it.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// renderPNGWithRetry fetches a panel's PNG, retrying with exponential
+// backoff for at most cfg.Grafana.MaxRetries attempts in all. If every
+// attempt fails, it
+// returns a non-nil *FailedPanel; when PartialOnError is set it first
+// writes a placeholder image in place of the missing panel PNG so the rest
+// of the pipeline can proceed as if the panel had rendered.
+func (rep *report) renderPNGWithRetry(p grafana.Panel) *FailedPanel {
+	c := rep.cfg()
+
+	maxAttempts := c.Grafana.MaxRetries
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	backoff := time.Duration(c.Grafana.RetryInterval) * time.Second
+	if backoff <= 0 {
+		backoff = defaultRetryInterval
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		lastErr = rep.renderPNG(p)
+		if lastErr == nil {
+			return nil
+		}
+		log.Errorf("creating image for panel ID %d (attempt %d/%d) error: %v", p.ID, attempt, maxAttempts, lastErr)
+		if attempt < maxAttempts {
+			time.Sleep(backoff * (1 << uint(attempt-1)))
+		}
+	}
+
+	failed := &FailedPanel{PanelID: p.ID, Title: p.Title, Error: lastErr.Error()}
+	if !c.Grafana.PartialOnError {
+		return failed
+	}
+
+	width, height := rep.targetPixelSize(p)
+	if err := rep.writePlaceholderImage(p, width, height, lastErr); err != nil {
+		log.Errorf("writing placeholder image for panel %d error: %v", p.ID, err)
+	}
+	return failed
+}
+
+// writePlaceholderImage draws a panel-sized image carrying the error text
+// (and Grafana HTTP status, when the error exposes one) and saves it where
+// the real panel PNG would have gone, so downstream layout code never has
+// to know the panel failed.
+func (rep *report) writePlaceholderImage(p grafana.Panel, width, height int, cause error) error {
+	if width <= 0 {
+		width = 480
+	}
+	if height <= 0 {
+		height = 240
+	}
+
+	lines := []string{fmt.Sprintf("Panel %q failed to render", p.Title)}
+	if sc, ok := cause.(statusCoder); ok {
+		lines[0] += fmt.Sprintf(" (HTTP %d)", sc.StatusCode())
+	}
+	lines = append(lines, cause.Error())
+
+	body, err := placeholderPNG(width, height, lines)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rep.imgFilePath(p), body, 0644)
+}
+
+// placeholderPNG renders lines of text over a light-grey panel-sized image.
+func placeholderPNG(width, height int, lines []string) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}}, image.Point{}, draw.Src)
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.RGBA{R: 0xb0, A: 0xff}),
+		Face: basicfont.Face7x13,
+	}
+	const lineHeight = 16
+	y := lineHeight
+	for _, line := range lines {
+		d.Dot = fixed.P(8, y)
+		d.DrawString(line)
+		y += lineHeight
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}